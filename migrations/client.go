@@ -0,0 +1,218 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultSource            = "default"
+	defaultSchema            = "storage"
+	defaultAdminSecretHeader = "X-Hasura-admin-secret" // nolint: gosec
+	defaultMaxRetries        = 3
+	defaultRetryBackoff      = 500 * time.Millisecond
+)
+
+// Sentinel errors callers can match on with errors.Is instead of comparing
+// hasuraErrResponse.Code strings.
+var (
+	ErrAlreadyTracked   = errors.New("hasura: table, relationship or trigger is already tracked")
+	ErrPermissionDenied = errors.New("hasura: permission denied")
+	ErrSourceNotFound   = errors.New("hasura: source not found")
+	ErrBulkNotSupported = errors.New("hasura: bulk metadata calls are not supported by this client")
+)
+
+// HasuraMetadataError wraps an error response returned by the metadata API
+// that doesn't map to one of the sentinel errors above.
+type HasuraMetadataError struct {
+	Path string
+	Code string
+}
+
+func (e *HasuraMetadataError) Error() string {
+	return fmt.Sprintf("hasura: %s (path: %s)", e.Code, e.Path)
+}
+
+func classifyError(resp hasuraErrResponse) error {
+	switch resp.Code {
+	case "already-tracked", "already-exists":
+		return ErrAlreadyTracked
+	case "access-denied", "permission-denied", "permission-error":
+		return ErrPermissionDenied
+	case "source-not-found", "not-exists":
+		return ErrSourceNotFound
+	default:
+		return &HasuraMetadataError{Path: resp.Path, Code: resp.Code}
+	}
+}
+
+// Config controls how a MetadataClient talks to a Hasura instance: which
+// source/schema to target, which header carries the admin secret, and the
+// retry/backoff and HTTP client behaviour to use.
+type Config struct {
+	// Source is the Hasura data source name ("default" for single-source
+	// deployments and most Hasura v1 instances).
+	Source string
+	// Schema is the Postgres schema the storage tables live in.
+	Schema string
+	// AdminSecretHeader lets deployments that proxy the admin secret under
+	// a different header (e.g. Hasura-Collaborator-Token, or a JWT in
+	// Authorization) override the default X-Hasura-admin-secret.
+	AdminSecretHeader string
+	// HTTPClient lets callers inject tracing, mTLS, or custom timeouts.
+	// Defaults to an http.Client with a 10s timeout.
+	HTTPClient *http.Client
+	// MaxRetries is how many additional attempts are made after a failed
+	// request before giving up. Defaults to 3.
+	MaxRetries int
+	// RetryBackoff is the base delay before the first retry; it doubles
+	// on each subsequent attempt. Defaults to 500ms.
+	RetryBackoff time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.Source == "" {
+		c.Source = defaultSource
+	}
+
+	if c.Schema == "" {
+		c.Schema = defaultSchema
+	}
+
+	if c.AdminSecretHeader == "" {
+		c.AdminSecretHeader = defaultAdminSecretHeader
+	}
+
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: time.Second * timeout}
+	}
+
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultRetryBackoff
+	}
+
+	return c
+}
+
+// MetadataClient sends payloads to a Hasura metadata API, retrying
+// transient failures and returning structured errors instead of the
+// previous string matching on hasuraErrResponse.Code.
+type MetadataClient interface {
+	// Send posts data to the metadata endpoint and returns the raw
+	// response body.
+	Send(data interface{}) ([]byte, error)
+	// Source is the data source this client targets.
+	Source() string
+	// Schema is the Postgres schema this client targets.
+	Schema() string
+}
+
+type v1Client struct {
+	cfg          Config
+	baseURL      string
+	hasuraSecret string
+}
+
+type v2Client struct {
+	cfg          Config
+	baseURL      string
+	hasuraSecret string
+}
+
+// NewV1Client returns a MetadataClient for Hasura v1 instances (single
+// Postgres source, `pg_*` metadata types, no bulk support).
+func NewV1Client(baseURL, hasuraSecret string, cfg Config) MetadataClient {
+	return &v1Client{cfg: cfg.withDefaults(), baseURL: baseURL, hasuraSecret: hasuraSecret}
+}
+
+// NewV2Client returns a MetadataClient for Hasura v2+ instances, which
+// support source-parameterized `pg_*` types and `bulk` requests.
+func NewV2Client(baseURL, hasuraSecret string, cfg Config) MetadataClient {
+	return &v2Client{cfg: cfg.withDefaults(), baseURL: baseURL, hasuraSecret: hasuraSecret}
+}
+
+func (c *v1Client) Source() string { return c.cfg.Source }
+func (c *v1Client) Schema() string { return c.cfg.Schema }
+
+func (c *v1Client) Send(data interface{}) ([]byte, error) {
+	if _, ok := data.(BulkMetadata); ok {
+		return nil, ErrBulkNotSupported
+	}
+
+	return sendWithRetry(c.cfg, c.baseURL, c.hasuraSecret, data)
+}
+
+func (c *v2Client) Source() string { return c.cfg.Source }
+func (c *v2Client) Schema() string { return c.cfg.Schema }
+
+func (c *v2Client) Send(data interface{}) ([]byte, error) {
+	return sendWithRetry(c.cfg, c.baseURL, c.hasuraSecret, data)
+}
+
+func sendWithRetry(cfg Config, baseURL, hasuraSecret string, data interface{}) ([]byte, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("problem marshalling data: %w", err)
+	}
+
+	var lastErr error
+
+	for attempt := 0; attempt <= cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(cfg.RetryBackoff * time.Duration(math.Pow(2, float64(attempt-1))))
+		}
+
+		body, err := doMetadataRequest(cfg, baseURL, hasuraSecret, b)
+		if err == nil {
+			return body, nil
+		}
+
+		if errors.Is(err, ErrAlreadyTracked) || errors.Is(err, ErrPermissionDenied) || errors.Is(err, ErrSourceNotFound) {
+			return nil, err
+		}
+
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("problem executing request after %d attempts: %w", cfg.MaxRetries+1, lastErr)
+}
+
+func doMetadataRequest(cfg Config, baseURL, hasuraSecret string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, baseURL+"/metadata", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("problem creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set(cfg.AdminSecretHeader, hasuraSecret)
+
+	resp, err := cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("problem executing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		var errResponse hasuraErrResponse
+		if err := json.Unmarshal(b, &errResponse); err != nil {
+			return nil, fmt.Errorf("status_code: %d\nresponse: %s", resp.StatusCode, b) // nolint: goerr113
+		}
+
+		return nil, classifyError(errResponse)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,142 @@
+package migrations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConfigWithDefaults(t *testing.T) {
+	cfg := Config{}.withDefaults()
+
+	if cfg.Source != defaultSource {
+		t.Errorf("Source = %q, want %q", cfg.Source, defaultSource)
+	}
+
+	if cfg.Schema != defaultSchema {
+		t.Errorf("Schema = %q, want %q", cfg.Schema, defaultSchema)
+	}
+
+	if cfg.AdminSecretHeader != defaultAdminSecretHeader {
+		t.Errorf("AdminSecretHeader = %q, want %q", cfg.AdminSecretHeader, defaultAdminSecretHeader)
+	}
+
+	if cfg.MaxRetries != defaultMaxRetries {
+		t.Errorf("MaxRetries = %d, want %d", cfg.MaxRetries, defaultMaxRetries)
+	}
+
+	if cfg.RetryBackoff != defaultRetryBackoff {
+		t.Errorf("RetryBackoff = %s, want %s", cfg.RetryBackoff, defaultRetryBackoff)
+	}
+
+	if cfg.HTTPClient == nil {
+		t.Error("HTTPClient is nil, want a default client")
+	}
+}
+
+func TestConfigWithDefaultsPreservesOverrides(t *testing.T) {
+	cfg := Config{Source: "custom", MaxRetries: 5}.withDefaults()
+
+	if cfg.Source != "custom" {
+		t.Errorf("Source = %q, want %q", cfg.Source, "custom")
+	}
+
+	if cfg.MaxRetries != 5 {
+		t.Errorf("MaxRetries = %d, want %d", cfg.MaxRetries, 5)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		code string
+		want error
+	}{
+		{"already-tracked", ErrAlreadyTracked},
+		{"already-exists", ErrAlreadyTracked},
+		{"access-denied", ErrPermissionDenied},
+		{"permission-denied", ErrPermissionDenied},
+		{"permission-error", ErrPermissionDenied},
+		{"source-not-found", ErrSourceNotFound},
+		{"not-exists", ErrSourceNotFound},
+	}
+
+	for _, tt := range tests {
+		got := classifyError(hasuraErrResponse{Code: tt.code})
+		if got != tt.want {
+			t.Errorf("classifyError(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+
+	unmapped := classifyError(hasuraErrResponse{Code: "something-else", Path: "$.args"})
+
+	metaErr, ok := unmapped.(*HasuraMetadataError)
+	if !ok {
+		t.Fatalf("classifyError(unmapped) = %v, want *HasuraMetadataError", unmapped)
+	}
+
+	if metaErr.Code != "something-else" || metaErr.Path != "$.args" {
+		t.Errorf("got %+v, want Code=something-else Path=$.args", metaErr)
+	}
+}
+
+func TestV1ClientRejectsBulk(t *testing.T) {
+	client := NewV1Client("http://example.invalid", "secret", Config{})
+
+	if _, err := client.Send(BulkMetadata{Type: "bulk"}); err != ErrBulkNotSupported {
+		t.Errorf("Send(BulkMetadata) err = %v, want %v", err, ErrBulkNotSupported)
+	}
+}
+
+func TestSendWithRetryRetriesTransientFailures(t *testing.T) {
+	var attempts int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{}`))
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer server.Close()
+
+	cfg := Config{MaxRetries: 3, RetryBackoff: time.Millisecond}.withDefaults()
+
+	client := NewV2Client(server.URL, "secret", cfg)
+
+	if _, err := client.Send(struct{}{}); err != nil {
+		t.Fatalf("Send() err = %v, want nil", err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestSendWithRetryStopsOnSentinelError(t *testing.T) {
+	var attempts int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code": "already-tracked"}`))
+	}))
+	defer server.Close()
+
+	cfg := Config{MaxRetries: 3, RetryBackoff: time.Millisecond}.withDefaults()
+
+	client := NewV2Client(server.URL, "secret", cfg)
+
+	if _, err := client.Send(struct{}{}); err != ErrAlreadyTracked {
+		t.Errorf("Send() err = %v, want %v", err, ErrAlreadyTracked)
+	}
+
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1 (should not retry a classified sentinel error)", attempts)
+	}
+}
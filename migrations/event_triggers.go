@@ -0,0 +1,278 @@
+package migrations
+
+const fileEventsTable = "file_events"
+
+// nolint: tagliatelle
+type EventTriggerOperationSpec struct {
+	Columns []string `json:"columns"`
+}
+
+// nolint: tagliatelle
+type EventTriggerDefinition struct {
+	Insert *EventTriggerOperationSpec `json:"insert,omitempty"`
+	Update *EventTriggerOperationSpec `json:"update,omitempty"`
+	Delete *EventTriggerOperationSpec `json:"delete,omitempty"`
+}
+
+// nolint: tagliatelle
+type EventTriggerHeader struct {
+	Name         string `json:"name"`
+	Value        string `json:"value,omitempty"`
+	ValueFromEnv string `json:"value_from_env,omitempty"`
+}
+
+// nolint: tagliatelle
+type EventTriggerRetryConf struct {
+	NumRetries  int `json:"num_retries"`
+	IntervalSec int `json:"interval_sec"`
+	TimeoutSec  int `json:"timeout_sec"`
+}
+
+// nolint: tagliatelle
+type CreateEventTriggerArgs struct {
+	Name       string                 `json:"name"`
+	Source     string                 `json:"source"`
+	Table      Table                  `json:"table"`
+	Webhook    string                 `json:"webhook"`
+	Definition EventTriggerDefinition `json:"definition"`
+	Headers    []EventTriggerHeader   `json:"headers,omitempty"`
+	RetryConf  EventTriggerRetryConf  `json:"retry_conf"`
+	// Replace makes pg_create_event_trigger reconcile idempotently
+	// against a trigger Hasura already has registered under this name,
+	// instead of erroring with "already-exists".
+	Replace bool `json:"replace"`
+}
+
+// CreateEventTrigger registers a webhook that fires on INSERT/UPDATE/DELETE
+// of a tracked table, so external systems can react to storage.files
+// changes without polling.
+type CreateEventTrigger struct {
+	Type string                 `json:"type"`
+	Args CreateEventTriggerArgs `json:"args"`
+}
+
+type DeleteEventTriggerArgs struct {
+	Name string `json:"name"`
+}
+
+type DeleteEventTrigger struct {
+	Type string                 `json:"type"`
+	Args DeleteEventTriggerArgs `json:"args"`
+}
+
+// EventTriggerConfig is an operator-declared webhook to register on
+// storage.files lifecycle events.
+type EventTriggerConfig struct {
+	Name       string
+	WebhookURL string
+	Headers    []EventTriggerHeader
+	// Columns restricts which columns are included in the event payload;
+	// defaults to every column ("*") when empty.
+	Columns []string
+	// Operations selects which of "insert", "update", "delete" to
+	// trigger on; defaults to all three when empty.
+	Operations []string
+	// NumRetries, IntervalSec and TimeoutSec default to 3, 10 and 60
+	// respectively when left at zero.
+	NumRetries  int
+	IntervalSec int
+	TimeoutSec  int
+}
+
+func (c EventTriggerConfig) columns() []string {
+	if len(c.Columns) == 0 {
+		return []string{"*"}
+	}
+
+	return c.Columns
+}
+
+func (c EventTriggerConfig) definition() EventTriggerDefinition {
+	ops := c.Operations
+	if len(ops) == 0 {
+		ops = []string{"insert", "update", "delete"}
+	}
+
+	var def EventTriggerDefinition
+
+	for _, op := range ops {
+		spec := &EventTriggerOperationSpec{Columns: c.columns()}
+
+		switch op {
+		case "insert":
+			def.Insert = spec
+		case "update":
+			def.Update = spec
+		case "delete":
+			def.Delete = spec
+		}
+	}
+
+	return def
+}
+
+func (c EventTriggerConfig) retryConf() EventTriggerRetryConf {
+	conf := EventTriggerRetryConf{NumRetries: c.NumRetries, IntervalSec: c.IntervalSec, TimeoutSec: c.TimeoutSec}
+
+	if conf.NumRetries == 0 {
+		conf.NumRetries = 3
+	}
+
+	if conf.IntervalSec == 0 {
+		conf.IntervalSec = 10
+	}
+
+	if conf.TimeoutSec == 0 {
+		conf.TimeoutSec = 60
+	}
+
+	return conf
+}
+
+// EventTriggersMigration registers webhooks on storage.files lifecycle
+// events and creates and tracks the storage.file_events audit table
+// (file_id, operation, payload), which is queryable via GraphQL. The
+// migration does not itself write event payloads into that table. This is a
+// prerequisite for on-upload processing pipelines such as virus scanning
+// or image processing.
+type EventTriggersMigration struct {
+	source   string
+	schema   string
+	triggers []EventTriggerConfig
+	roles    []RolePermission
+}
+
+// NewEventTriggersMigration returns a Migration that registers triggers and
+// grants roles select access to the resulting storage.file_events table.
+func NewEventTriggersMigration(client MetadataClient, triggers []EventTriggerConfig, roles []RolePermission) *EventTriggersMigration {
+	return &EventTriggersMigration{source: client.Source(), schema: client.Schema(), triggers: triggers, roles: roles}
+}
+
+func (e *EventTriggersMigration) Version() string { return "20220301000000_storage_file_events" }
+func (e *EventTriggersMigration) Name() string {
+	return "file lifecycle event triggers and audit table"
+}
+
+func (e *EventTriggersMigration) fileEventsTable() Table {
+	return Table{Schema: e.schema, Name: fileEventsTable}
+}
+
+// nolint: funlen
+func (e *EventTriggersMigration) Up() []interface{} {
+	args := []interface{}{
+		RunSQL{
+			Type: "run_sql",
+			Args: RunSQLArgs{
+				Source: e.source,
+				SQL: `CREATE TABLE IF NOT EXISTS ` + e.schema + `.` + fileEventsTable + ` (
+					id SERIAL PRIMARY KEY,
+					file_id UUID NOT NULL REFERENCES ` + e.schema + `.files(id) ON DELETE CASCADE,
+					operation TEXT NOT NULL,
+					payload JSONB NOT NULL,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+				)`,
+			},
+		},
+		TrackTable{
+			Type: "pg_track_table",
+			Args: PgTrackTableArgs{
+				Source: e.source,
+				Table:  e.fileEventsTable(),
+				Configuration: Configuration{
+					CustomName: "fileEvents",
+					CustomRootFields: CustomRootFields{
+						Select:          "fileEvents",
+						SelectByPk:      "fileEvent",
+						SelectAggregate: "fileEventsAggregate",
+					},
+					CustomColumnNames: map[string]string{
+						"id":         "id",
+						"file_id":    "fileId",
+						"operation":  "operation",
+						"payload":    "payload",
+						"created_at": "createdAt",
+					},
+				},
+			},
+		},
+		CreateObjectRelationship{
+			Type: "pg_create_object_relationship",
+			Args: CreateObjectRelationshipArgs{
+				Table:  e.fileEventsTable(),
+				Name:   "file",
+				Source: e.source,
+				Using: CreateObjectRelationshipUsing{
+					ForeignKeyConstraintOn: []string{"file_id"},
+				},
+			},
+		},
+	}
+
+	for _, role := range e.roles {
+		args = append(args, CreateSelectPermission{
+			Type: "pg_create_select_permission",
+			Args: CreateSelectPermissionArgs{
+				Source: e.source,
+				Table:  e.fileEventsTable(),
+				Role:   role.Role,
+				Permission: SelectPermissionDefinition{
+					Columns: role.columns(),
+					Filter:  role.filter(fileEventsTable),
+				},
+			},
+		})
+	}
+
+	for _, trigger := range e.triggers {
+		args = append(args, CreateEventTrigger{
+			Type: "pg_create_event_trigger",
+			Args: CreateEventTriggerArgs{
+				Name:       trigger.Name,
+				Source:     e.source,
+				Table:      Table{Schema: e.schema, Name: "files"},
+				Webhook:    trigger.WebhookURL,
+				Definition: trigger.definition(),
+				Headers:    trigger.Headers,
+				RetryConf:  trigger.retryConf(),
+				Replace:    true,
+			},
+		})
+	}
+
+	return args
+}
+
+func (e *EventTriggersMigration) Down() []interface{} {
+	var args []interface{}
+
+	for _, trigger := range e.triggers {
+		args = append(args, DeleteEventTrigger{
+			Type: "pg_delete_event_trigger",
+			Args: DeleteEventTriggerArgs{Name: trigger.Name},
+		})
+	}
+
+	for _, role := range e.roles {
+		args = append(args, newDropPermission("pg_drop_select_permission", e.source, e.fileEventsTable(), role.Role))
+	}
+
+	args = append(args,
+		DropRelationship{
+			Type: "pg_drop_relationship",
+			Args: DropRelationshipArgs{Source: e.source, Table: e.fileEventsTable(), RelationshipName: "file"},
+		},
+		UntrackTable{
+			Type: "pg_untrack_table",
+			Args: UntrackTableArgs{Source: e.source, Table: e.fileEventsTable()},
+		},
+		RunSQL{
+			Type: "run_sql",
+			Args: RunSQLArgs{
+				Source: e.source,
+				SQL:    `DROP TABLE IF EXISTS ` + e.schema + `.` + fileEventsTable,
+			},
+		},
+	)
+
+	return args
+}
@@ -0,0 +1,131 @@
+package migrations
+
+import "testing"
+
+func TestEventTriggerConfigDefaults(t *testing.T) {
+	c := EventTriggerConfig{}
+
+	if cols := c.columns(); len(cols) != 1 || cols[0] != "*" {
+		t.Errorf("columns() = %v, want [\"*\"]", cols)
+	}
+
+	def := c.definition()
+	if def.Insert == nil || def.Update == nil || def.Delete == nil {
+		t.Errorf("definition() = %+v, want insert/update/delete all set", def)
+	}
+
+	retry := c.retryConf()
+	if retry.NumRetries != 3 || retry.IntervalSec != 10 || retry.TimeoutSec != 60 {
+		t.Errorf("retryConf() = %+v, want {3 10 60}", retry)
+	}
+}
+
+func TestEventTriggerConfigOperationsSubset(t *testing.T) {
+	c := EventTriggerConfig{Operations: []string{"insert"}}
+
+	def := c.definition()
+	if def.Insert == nil {
+		t.Error("definition() has no Insert, want one")
+	}
+
+	if def.Update != nil || def.Delete != nil {
+		t.Errorf("definition() = %+v, want only Insert set", def)
+	}
+}
+
+func TestEventTriggersMigrationUpTracksFileRelationshipAndPermissions(t *testing.T) {
+	client := &fakeClient{applied: make(map[string]string)}
+
+	roles := []RolePermission{
+		{Role: "user", Preset: PermissionPresetOwnerOnly},
+		{Role: "anonymous", Preset: PermissionPresetPublicRead},
+	}
+
+	triggers := []EventTriggerConfig{{Name: "on_file_change", WebhookURL: "http://example.invalid"}}
+
+	mig := NewEventTriggersMigration(client, triggers, roles)
+
+	var (
+		sawRelationship bool
+		sawTrigger      bool
+		selectCount     int
+	)
+
+	for _, arg := range mig.Up() {
+		switch v := arg.(type) {
+		case CreateObjectRelationship:
+			if v.Args.Name != "file" || v.Args.Table.Name != fileEventsTable {
+				t.Errorf("unexpected relationship %+v", v)
+			}
+
+			sawRelationship = true
+		case CreateSelectPermission:
+			selectCount++
+
+			if v.Args.Role == "user" {
+				if _, ok := v.Args.Permission.Filter["file"]; !ok {
+					t.Errorf("owner_only filter for file_events = %v, want scoped through \"file\" relationship", v.Args.Permission.Filter)
+				}
+			}
+		case CreateEventTrigger:
+			sawTrigger = true
+		}
+	}
+
+	if !sawRelationship {
+		t.Error("Up() never tracked the file_events -> files \"file\" relationship")
+	}
+
+	if !sawTrigger {
+		t.Error("Up() never registered the configured event trigger")
+	}
+
+	if selectCount != len(roles) {
+		t.Errorf("got %d select permissions, want %d (one per role)", selectCount, len(roles))
+	}
+}
+
+func TestEventTriggersMigrationDownMirrorsUp(t *testing.T) {
+	client := &fakeClient{applied: make(map[string]string)}
+
+	roles := []RolePermission{{Role: "user", Preset: PermissionPresetOwnerOnly}}
+	triggers := []EventTriggerConfig{{Name: "on_file_change", WebhookURL: "http://example.invalid"}}
+
+	mig := NewEventTriggersMigration(client, triggers, roles)
+
+	var (
+		sawDeleteTrigger    bool
+		sawDropPermission   bool
+		sawDropRelationship bool
+		sawUntrackTable     bool
+		sawDropTable        bool
+	)
+
+	for _, arg := range mig.Down() {
+		switch v := arg.(type) {
+		case DeleteEventTrigger:
+			sawDeleteTrigger = true
+		case dropPermission:
+			sawDropPermission = true
+		case DropRelationship:
+			if v.Args.RelationshipName != "file" {
+				t.Errorf("dropped relationship %q, want \"file\"", v.Args.RelationshipName)
+			}
+
+			sawDropRelationship = true
+		case UntrackTable:
+			if v.Args.Table.Name != fileEventsTable {
+				t.Errorf("untracked table %q, want %q", v.Args.Table.Name, fileEventsTable)
+			}
+
+			sawUntrackTable = true
+		case RunSQL:
+			sawDropTable = true
+		}
+	}
+
+	if !sawDeleteTrigger || !sawDropPermission || !sawDropRelationship || !sawUntrackTable || !sawDropTable {
+		t.Errorf("Down() did not fully mirror Up(): deleteTrigger=%v dropPermission=%v dropRelationship=%v untrackTable=%v dropTable=%v",
+			sawDeleteTrigger, sawDropPermission, sawDropRelationship, sawUntrackTable, sawDropTable)
+	}
+}
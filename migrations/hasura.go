@@ -1,13 +1,7 @@
 package migrations
 
 import (
-	"bytes"
-	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"time"
+	"errors"
 
 	"github.com/sirupsen/logrus"
 )
@@ -22,45 +16,6 @@ type hasuraErrResponse struct {
 	Code  string `json:"code"`
 }
 
-func postMetadata(baseURL, hasuraSecret string, data interface{}) error {
-	client := &http.Client{
-		Timeout: time.Second * timeout,
-	}
-
-	b, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("problem marshalling data: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, baseURL+"/metadata", bytes.NewBuffer(b))
-	if err != nil {
-		return fmt.Errorf("problem creating request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	req.Header.Set("X-Hasura-admin-secret", hasuraSecret)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("problem executing request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		var errResponse *hasuraErrResponse
-		b, _ := io.ReadAll(resp.Body)
-		if err := json.Unmarshal(b, &errResponse); err != nil {
-			return fmt.Errorf("status_code: %d\nresponse: %s", resp.StatusCode, b) // nolint: goerr113
-		}
-		if errResponse.Code == "already-tracked" || errResponse.Code == "already-exists" {
-			return nil
-		}
-		return fmt.Errorf("status_code: %d\nresponse: %s", resp.StatusCode, b) // nolint: goerr113
-	}
-
-	return nil
-}
-
 type TrackTable struct {
 	Type string           `json:"type"`
 	Args PgTrackTableArgs `json:"args"`
@@ -97,6 +52,17 @@ type PgTrackTableArgs struct {
 	Configuration Configuration `json:"configuration"`
 }
 
+// UntrackTable reverses TrackTable.
+type UntrackTable struct {
+	Type string           `json:"type"`
+	Args UntrackTableArgs `json:"args"`
+}
+
+type UntrackTableArgs struct {
+	Source string `json:"source"`
+	Table  Table  `json:"table"`
+}
+
 type CreateObjectRelationship struct {
 	Type string                       `json:"type"`
 	Args CreateObjectRelationshipArgs `json:"args"`
@@ -136,151 +102,221 @@ type CreateArrayRelationshipArgs struct {
 	Using  CreateArrayRelationshipUsing `json:"using"`
 }
 
+// DropRelationship reverses CreateObjectRelationship/CreateArrayRelationship.
+type DropRelationship struct {
+	Type string               `json:"type"`
+	Args DropRelationshipArgs `json:"args"`
+}
+
+// nolint: tagliatelle
+type DropRelationshipArgs struct {
+	Source           string `json:"source"`
+	Table            Table  `json:"table"`
+	RelationshipName string `json:"relationship"`
+}
+
+// baseMigration tracks storage.buckets and storage.files and the
+// relationships between them. It's always the first migration
+// ApplyHasuraMetadata applies.
+type baseMigration struct {
+	source string
+	schema string
+}
+
+func newBaseMigration(source, schema string) *baseMigration {
+	return &baseMigration{source: source, schema: schema}
+}
+
+func (b *baseMigration) Version() string { return "20210101000000_storage_base" }
+func (b *baseMigration) Name() string    { return "track storage.buckets and storage.files" }
+
+func (b *baseMigration) bucketsTable() Table { return Table{Schema: b.schema, Name: "buckets"} }
+func (b *baseMigration) filesTable() Table   { return Table{Schema: b.schema, Name: "files"} }
+
 // nolint: funlen
-func ApplyHasuraMetadata(url, hasuraSecret string, logger *logrus.Logger) error {
-	bucketsTable := TrackTable{
-		Type: "pg_track_table",
-		Args: PgTrackTableArgs{
-			Source: "default",
-			Table: Table{
-				Schema: "storage",
-				Name:   "buckets",
+func (b *baseMigration) Up() []interface{} {
+	return []interface{}{
+		TrackTable{
+			Type: "pg_track_table",
+			Args: PgTrackTableArgs{
+				Source: b.source,
+				Table:  b.bucketsTable(),
+				Configuration: Configuration{
+					CustomName: "buckets",
+					CustomRootFields: CustomRootFields{
+						Select:          "buckets",
+						SelectByPk:      "bucket",
+						SelectAggregate: "bucketsAggregate",
+						Insert:          "insertBuckets",
+						InsertOne:       "insertBucket",
+						Update:          "updateBuckets",
+						UpdateByPk:      "updateBucket",
+						Delete:          "deleteBuckets",
+						DeleteByPk:      "deleteBucket",
+					},
+					CustomColumnNames: map[string]string{
+						"id":                     "id",
+						"created_at":             "createdAt",
+						"updated_at":             "updatedAt",
+						"download_expiration":    "downloadExpiration",
+						"min_upload_file_size":   "minUploadFileSize",
+						"max_upload_file_size":   "maxUploadFileSize",
+						"cache_control":          "cacheControl",
+						"presigned_urls_enabled": "presignedUrlsEnabled",
+					},
+				},
 			},
-			Configuration: Configuration{
-				CustomName: "buckets",
-				CustomRootFields: CustomRootFields{
-					Select:          "buckets",
-					SelectByPk:      "bucket",
-					SelectAggregate: "bucketsAggregate",
-					Insert:          "insertBuckets",
-					InsertOne:       "insertBucket",
-					Update:          "updateBuckets",
-					UpdateByPk:      "updateBucket",
-					Delete:          "deleteBuckets",
-					DeleteByPk:      "deleteBucket",
+		},
+		TrackTable{
+			Type: "pg_track_table",
+			Args: PgTrackTableArgs{
+				Source: b.source,
+				Table:  b.filesTable(),
+				Configuration: Configuration{
+					CustomName: "files",
+					CustomRootFields: CustomRootFields{
+						Select:          "files",
+						SelectByPk:      "file",
+						SelectAggregate: "filesAggregate",
+						Insert:          "insertFiles",
+						InsertOne:       "insertFile",
+						Update:          "updateFiles",
+						UpdateByPk:      "updateFile",
+						Delete:          "deleteFiles",
+						DeleteByPk:      "deleteFile",
+					},
+					CustomColumnNames: map[string]string{
+						"id":                  "id",
+						"created_at":          "createdAt",
+						"updated_at":          "updatedAt",
+						"bucket_id":           "bucketId",
+						"name":                "name",
+						"size":                "size",
+						"mime_type":           "mimeType",
+						"etag":                "etag",
+						"is_uploaded":         "isUploaded",
+						"uploaded_by_user_id": "uploadedByUserId",
+					},
 				},
-				CustomColumnNames: map[string]string{
-					"id":                     "id",
-					"created_at":             "createdAt",
-					"updated_at":             "updatedAt",
-					"download_expiration":    "downloadExpiration",
-					"min_upload_file_size":   "minUploadFileSize",
-					"max_upload_file_size":   "maxUploadFileSize",
-					"cache_control":          "cacheControl",
-					"presigned_urls_enabled": "presignedUrlsEnabled",
+			},
+		},
+		CreateObjectRelationship{
+			Type: "pg_create_object_relationship",
+			Args: CreateObjectRelationshipArgs{
+				Table:  b.filesTable(),
+				Name:   "bucket",
+				Source: b.source,
+				Using: CreateObjectRelationshipUsing{
+					ForeignKeyConstraintOn: []string{"bucket_id"},
 				},
 			},
 		},
-	}
-
-	if err := postMetadata(url, hasuraSecret, bucketsTable); err != nil {
-		return fmt.Errorf("problem adding metadata for the buckets table: %w", err)
-	}
-
-	filesTable := TrackTable{
-		Type: "pg_track_table",
-		Args: PgTrackTableArgs{
-			Source: "default",
-			Table: Table{
-				Schema: "storage",
+		CreateArrayRelationship{
+			Type: "pg_create_array_relationship",
+			Args: CreateArrayRelationshipArgs{
+				Table:  b.bucketsTable(),
 				Name:   "files",
-			},
-			Configuration: Configuration{
-				CustomName: "files",
-				CustomRootFields: CustomRootFields{
-					Select:          "files",
-					SelectByPk:      "file",
-					SelectAggregate: "filesAggregate",
-					Insert:          "insertFiles",
-					InsertOne:       "insertFile",
-					Update:          "updateFiles",
-					UpdateByPk:      "updateFile",
-					Delete:          "deleteFiles",
-					DeleteByPk:      "deleteFile",
-				},
-				CustomColumnNames: map[string]string{
-					"id":                  "id",
-					"created_at":          "createdAt",
-					"updated_at":          "updatedAt",
-					"bucket_id":           "bucketId",
-					"name":                "name",
-					"size":                "size",
-					"mime_type":           "mimeType",
-					"etag":                "etag",
-					"is_uploaded":         "isUploaded",
-					"uploaded_by_user_id": "uploadedByUserId",
+				Source: b.source,
+				Using: CreateArrayRelationshipUsing{
+					ForeignKeyConstraintOn: ForeignKeyConstraintOn{
+						Table:   b.filesTable(),
+						Columns: []string{"bucket_id"},
+					},
 				},
 			},
 		},
 	}
+}
 
-	if err := postMetadata(url, hasuraSecret, filesTable); err != nil {
-		return fmt.Errorf("problem adding metadata for the files table: %w", err)
+func (b *baseMigration) Down() []interface{} {
+	return []interface{}{
+		DropRelationship{
+			Type: "pg_drop_relationship",
+			Args: DropRelationshipArgs{Source: b.source, Table: b.bucketsTable(), RelationshipName: "files"},
+		},
+		DropRelationship{
+			Type: "pg_drop_relationship",
+			Args: DropRelationshipArgs{Source: b.source, Table: b.filesTable(), RelationshipName: "bucket"},
+		},
+		UntrackTable{
+			Type: "pg_untrack_table",
+			Args: UntrackTableArgs{Source: b.source, Table: b.filesTable()},
+		},
+		UntrackTable{
+			Type: "pg_untrack_table",
+			Args: UntrackTableArgs{Source: b.source, Table: b.bucketsTable()},
+		},
 	}
+}
 
-	objRelationshipBuckets := CreateObjectRelationship{
+// applyUserRelationship best-effort tracks the files -> users relationship.
+// It's kept outside the migration set and its failure is only warned about,
+// since the users table doesn't exist when storage runs standalone without
+// auth, and that's not something operators need to fix.
+func applyUserRelationship(client MetadataClient, schema string, logger *logrus.Logger) {
+	rel := CreateObjectRelationship{
 		Type: "pg_create_object_relationship",
 		Args: CreateObjectRelationshipArgs{
-			Table: Table{
-				Schema: "storage",
-				Name:   "files",
-			},
-			Name:   "bucket",
-			Source: "default",
+			Table:  Table{Schema: schema, Name: "files"},
+			Name:   "uploadedByUser",
+			Source: client.Source(),
 			Using: CreateObjectRelationshipUsing{
-				ForeignKeyConstraintOn: []string{"bucket_id"},
+				ForeignKeyConstraintOn: []string{"uploaded_by_user_id"},
 			},
 		},
 	}
 
-	if err := postMetadata(url, hasuraSecret, objRelationshipBuckets); err != nil {
-		return fmt.Errorf("problem creaiing object relationship for buckets: %w", err)
+	if _, err := client.Send(rel); err != nil && !errors.Is(err, ErrAlreadyTracked) {
+		logger.Warnf("problem creating object relationship for users: %s", err)
 	}
+}
 
-	arrRelationship := CreateArrayRelationship{
-		Type: "pg_create_array_relationship",
-		Args: CreateArrayRelationshipArgs{
-			Table: Table{
-				Schema: "storage",
-				Name:   "buckets",
-			},
-			Name:   "files",
-			Source: "default",
-			Using: CreateArrayRelationshipUsing{
-				ForeignKeyConstraintOn: ForeignKeyConstraintOn{
-					Table: Table{
-						Schema: "storage",
-						Name:   "files",
-					},
-					Columns: []string{"bucket_id"},
-				},
-			},
-		},
+// ApplyOptions bundles the migrations ApplyHasuraMetadata wires in
+// alongside the base buckets/files/relationships tracking. Roles,
+// EventTriggers and Purge are each only added to the migration set when
+// the caller supplies them, so existing deployments that don't ask for
+// permissions, purging or event triggers are unaffected.
+type ApplyOptions struct {
+	// Roles, when non-empty, provisions row-level permissions via
+	// PermissionsMigration. Pass DefaultRoles for the built-in
+	// user/anonymous/service roles.
+	Roles []RolePermission
+	// EventTriggers, when non-empty, registers webhooks on storage.files
+	// lifecycle events via EventTriggersMigration.
+	EventTriggers []EventTriggerConfig
+	// Purge registers the scheduled purge cron trigger when Enabled.
+	Purge PurgeConfig
+	// DryRun logs the payloads each pending migration would send instead
+	// of sending them.
+	DryRun bool
+}
+
+// ApplyHasuraMetadata tracks the storage tables and relationships against
+// the source and schema client was configured with, plus any of the
+// optional migrations requested in opts. Every migration is driven through
+// a Migrator, so application is atomic per migration (for clients that
+// support bulk calls), versioned in
+// storage.hasura_metadata_migrations, and safe to re-run.
+func ApplyHasuraMetadata(client MetadataClient, opts ApplyOptions, logger *logrus.Logger) error {
+	migrations := []Migration{newBaseMigration(client.Source(), client.Schema())}
+
+	if len(opts.Roles) > 0 {
+		migrations = append(migrations, NewPermissionsMigration(client, opts.Roles))
 	}
 
-	if err := postMetadata(url, hasuraSecret, arrRelationship); err != nil {
-		return fmt.Errorf("problem creating array relationships: %w", err)
+	if opts.Purge.Enabled {
+		migrations = append(migrations, NewPurgeMigration(opts.Purge))
 	}
 
-	objRelationshipUser := CreateObjectRelationship{
-		Type: "pg_create_object_relationship",
-		Args: CreateObjectRelationshipArgs{
-			Table: Table{
-				Schema: "storage",
-				Name:   "files",
-			},
-			Name:   "uploadedByUser",
-			Source: "default",
-			Using: CreateObjectRelationshipUsing{
-				ForeignKeyConstraintOn: []string{"uploaded_by_user_id"},
-			},
-		},
+	if len(opts.EventTriggers) > 0 {
+		migrations = append(migrations, NewEventTriggersMigration(client, opts.EventTriggers, opts.Roles))
 	}
 
-	if err := postMetadata(url, hasuraSecret, objRelationshipUser); err != nil {
-		// we warn and ignore this error as this can be an issue if storage is running standalone without auth
-		logger.Warnf("problem creating object relationship for users: %s", err)
+	if err := NewMigrator(client, opts.DryRun, logger).Apply(migrations); err != nil {
+		return err
 	}
 
+	applyUserRelationship(client, client.Schema(), logger)
+
 	return nil
 }
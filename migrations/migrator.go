@@ -0,0 +1,378 @@
+package migrations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const migrationsTable = "storage.hasura_metadata_migrations"
+
+// sqlLiteralPattern is deliberately narrow: migration versions and
+// checksums are either compile-time literals or hex digests, never
+// arbitrary user input, but recordMigration/deleteMigrationRecord build
+// SQL by string interpolation (run_sql has no parameterized query support),
+// so values are validated against this pattern before being interpolated.
+var sqlLiteralPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+func sqlLiteral(value string) (string, error) {
+	if !sqlLiteralPattern.MatchString(value) {
+		return "", fmt.Errorf("invalid migration identifier %q", value) // nolint: goerr113
+	}
+
+	return value, nil
+}
+
+// Migration is a single, versioned change to Hasura metadata. Versions must
+// sort lexicographically in the order the migrations are meant to apply
+// (e.g. "20210101120000_track_files").
+type Migration interface {
+	// Version returns the migration's unique, sortable identifier.
+	Version() string
+	// Name is a short human readable description, stored alongside the
+	// version so operators can inspect storage.hasura_metadata_migrations
+	// without cross-referencing the binary.
+	Name() string
+	// Up returns the metadata API payload(s) that apply the migration.
+	Up() []interface{}
+	// Down returns the metadata API payload(s) that reverse the migration.
+	Down() []interface{}
+}
+
+// BulkMetadata wraps several metadata API calls so Hasura applies them
+// atomically in a single request instead of N sequential POSTs.
+type BulkMetadata struct {
+	Type string        `json:"type"`
+	Args []interface{} `json:"args"`
+}
+
+// RunSQL executes raw SQL against a Hasura source through the metadata API,
+// used here to maintain the migrations bookkeeping table.
+type RunSQL struct {
+	Type string     `json:"type"`
+	Args RunSQLArgs `json:"args"`
+}
+
+type RunSQLArgs struct {
+	Source  string `json:"source"`
+	SQL     string `json:"sql"`
+	Cascade bool   `json:"cascade"`
+}
+
+type runSQLResponse struct {
+	ResultType string     `json:"result_type"`
+	Result     [][]string `json:"result"`
+}
+
+// AppliedMigration is a row of storage.hasura_metadata_migrations.
+// nolint: tagliatelle
+type AppliedMigration struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"applied_at"`
+	Checksum  string `json:"checksum"`
+}
+
+// Migrator applies Migration values to a Hasura instance and keeps track of
+// which ones have already run in storage.hasura_metadata_migrations.
+type Migrator struct {
+	client MetadataClient
+	dryRun bool
+	logger *logrus.Logger
+}
+
+// NewMigrator returns a Migrator that sends migrations through client. When
+// dryRun is true, Apply and RollbackTo log the payload they would send
+// instead of sending it.
+func NewMigrator(client MetadataClient, dryRun bool, logger *logrus.Logger) *Migrator {
+	return &Migrator{
+		client: client,
+		dryRun: dryRun,
+		logger: logger,
+	}
+}
+
+func (m *Migrator) ensureMigrationsTable() error {
+	runSQL := RunSQL{
+		Type: "run_sql",
+		Args: RunSQLArgs{
+			Source: m.client.Source(),
+			SQL: `CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (
+				id SERIAL PRIMARY KEY,
+				name TEXT NOT NULL UNIQUE,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				checksum TEXT NOT NULL
+			)`,
+			Cascade: false,
+		},
+	}
+
+	if _, err := m.client.Send(runSQL); err != nil {
+		return fmt.Errorf("problem creating migrations table: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Migrator) appliedVersions() (map[string]AppliedMigration, error) {
+	runSQL := RunSQL{
+		Type: "run_sql",
+		Args: RunSQLArgs{
+			Source: m.client.Source(),
+			SQL:    `SELECT name, applied_at, checksum FROM ` + migrationsTable,
+		},
+	}
+
+	body, err := m.client.Send(runSQL)
+	if err != nil {
+		return nil, fmt.Errorf("problem querying migrations table: %w", err)
+	}
+
+	var resp runSQLResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("problem parsing migrations table response: %w", err)
+	}
+
+	applied := make(map[string]AppliedMigration)
+	for _, row := range resp.Result[1:] { // first row is the column header
+		if len(row) != 3 {
+			continue
+		}
+		applied[row[0]] = AppliedMigration{Name: row[0], AppliedAt: row[1], Checksum: row[2]}
+	}
+
+	return applied, nil
+}
+
+func (m *Migrator) recordMigration(mig Migration) error {
+	version, err := sqlLiteral(mig.Version())
+	if err != nil {
+		return fmt.Errorf("problem recording migration: %w", err)
+	}
+
+	sum, err := sqlLiteral(checksum(mig))
+	if err != nil {
+		return fmt.Errorf("problem recording migration %s: %w", mig.Version(), err)
+	}
+
+	runSQL := RunSQL{
+		Type: "run_sql",
+		Args: RunSQLArgs{
+			Source: m.client.Source(),
+			SQL:    fmt.Sprintf(`INSERT INTO %s (name, checksum) VALUES ('%s', '%s')`, migrationsTable, version, sum),
+		},
+	}
+
+	if _, err := m.client.Send(runSQL); err != nil {
+		return fmt.Errorf("problem recording migration %s: %w", mig.Version(), err)
+	}
+
+	return nil
+}
+
+func (m *Migrator) deleteMigrationRecord(version string) error {
+	version, err := sqlLiteral(version)
+	if err != nil {
+		return fmt.Errorf("problem deleting migration record: %w", err)
+	}
+
+	runSQL := RunSQL{
+		Type: "run_sql",
+		Args: RunSQLArgs{
+			Source: m.client.Source(),
+			SQL:    fmt.Sprintf(`DELETE FROM %s WHERE name = '%s'`, migrationsTable, version),
+		},
+	}
+
+	if _, err := m.client.Send(runSQL); err != nil {
+		return fmt.Errorf("problem deleting migration record %s: %w", version, err)
+	}
+
+	return nil
+}
+
+// sendArgs sends args as a single bulk call when the client supports it,
+// falling back to sequential per-item sends when it doesn't (v1 clients
+// return ErrBulkNotSupported for "bulk"). A bulk call that fails with
+// ErrAlreadyTracked applied none of its items, so they are also resent one
+// by one; ErrAlreadyTracked is tolerated per item, so re-running Apply
+// against a migration that partially applied before a failure can recover
+// instead of hard-failing forever.
+func (m *Migrator) sendArgs(args []interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	_, err := m.client.Send(BulkMetadata{Type: "bulk", Args: args})
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrBulkNotSupported), errors.Is(err, ErrAlreadyTracked):
+		for _, arg := range args {
+			if _, err := m.client.Send(arg); err != nil && !errors.Is(err, ErrAlreadyTracked) {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return err
+	}
+}
+
+func checksum(mig Migration) string {
+	b, _ := json.Marshal(mig.Up()) // nolint: errcheck
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Apply runs every migration in migrations that has not yet been recorded
+// in storage.hasura_metadata_migrations. Each migration's Up() is sent as
+// one atomic bulk call (item by item for clients without bulk support, see
+// sendArgs) and recorded immediately afterwards, so a failure
+// partway through the list leaves every prior migration both applied and
+// recorded rather than applied-but-unrecorded.
+func (m *Migrator) Apply(migrations []Migration) error {
+	if err := m.ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range migrations {
+		if _, ok := applied[mig.Version()]; ok {
+			continue
+		}
+
+		if err := m.applyMigration(mig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) applyMigration(mig Migration) error {
+	args := mig.Up()
+
+	if m.dryRun {
+		return m.logDryRun("apply "+mig.Version(), BulkMetadata{Type: "bulk", Args: args})
+	}
+
+	if err := m.sendArgs(args); err != nil {
+		return fmt.Errorf("problem applying migration %s: %w", mig.Version(), err)
+	}
+
+	return m.recordMigration(mig)
+}
+
+// RollbackTo reverses every applied migration whose version is greater than
+// target, most recent first, recording each rollback immediately so a
+// failure partway through leaves bookkeeping consistent with what was
+// actually rolled back.
+func (m *Migrator) RollbackTo(target string, migrations []Migration) error {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version() > sorted[j].Version() })
+
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range sorted {
+		if mig.Version() <= target {
+			break
+		}
+
+		if _, ok := applied[mig.Version()]; !ok {
+			continue
+		}
+
+		if err := m.rollbackMigration(mig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) rollbackMigration(mig Migration) error {
+	args := mig.Down()
+
+	if m.dryRun {
+		return m.logDryRun("rollback "+mig.Version(), BulkMetadata{Type: "bulk", Args: args})
+	}
+
+	if err := m.sendArgs(args); err != nil {
+		return fmt.Errorf("problem rolling back migration %s: %w", mig.Version(), err)
+	}
+
+	return m.deleteMigrationRecord(mig.Version())
+}
+
+func (m *Migrator) logDryRun(action string, bulk BulkMetadata) error {
+	payload, err := json.MarshalIndent(bulk, "", "  ")
+	if err != nil {
+		return fmt.Errorf("problem marshalling dry-run payload: %w", err)
+	}
+
+	m.logger.Infof("dry-run %s, would send:\n%s", action, payload)
+
+	return nil
+}
+
+// Diff reports drift between migrations and what's recorded in
+// storage.hasura_metadata_migrations: migrations that haven't been applied
+// yet, migrations whose Up() payload has changed since it was applied (so
+// its checksum no longer matches), and recorded rows that don't correspond
+// to any migration in the list anymore.
+func (m *Migrator) Diff(migrations []Migration) (string, error) {
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return "", err
+	}
+
+	known := make(map[string]bool, len(migrations))
+
+	var lines []string
+
+	for _, mig := range migrations {
+		known[mig.Version()] = true
+
+		row, ok := applied[mig.Version()]
+
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("pending: %s (%s)", mig.Version(), mig.Name()))
+		case row.Checksum != checksum(mig):
+			lines = append(lines, fmt.Sprintf("changed: %s (%s) has a different Up() payload than when it was applied", mig.Version(), mig.Name()))
+		}
+	}
+
+	for version := range applied {
+		if !known[version] {
+			lines = append(lines, fmt.Sprintf("orphaned: %s is recorded as applied but is no longer a known migration", version))
+		}
+	}
+
+	if len(lines) == 0 {
+		return "no drift: every known migration is applied and unchanged", nil
+	}
+
+	sort.Strings(lines)
+
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,370 @@
+package migrations
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSqlLiteral(t *testing.T) {
+	valid := []string{"20210101000000_storage_base", "a1b2c3", "foo.bar:baz-1"}
+	for _, v := range valid {
+		if _, err := sqlLiteral(v); err != nil {
+			t.Errorf("sqlLiteral(%q) err = %v, want nil", v, err)
+		}
+	}
+
+	invalid := []string{"", "foo'; DROP TABLE x; --", "has space", "semi;colon"}
+	for _, v := range invalid {
+		if _, err := sqlLiteral(v); err == nil {
+			t.Errorf("sqlLiteral(%q) err = nil, want error", v)
+		}
+	}
+}
+
+func TestChecksumDiffersByPayload(t *testing.T) {
+	a := testMigration{version: "v1", up: func() []interface{} { return []interface{}{"a"} }}
+	b := testMigration{version: "v1", up: func() []interface{} { return []interface{}{"b"} }}
+
+	if checksum(a) == checksum(b) {
+		t.Error("checksum(a) == checksum(b), want different checksums for different payloads")
+	}
+
+	if checksum(a) != checksum(a) {
+		t.Error("checksum(a) is not stable across calls")
+	}
+}
+
+func TestSendArgsEmpty(t *testing.T) {
+	f := newFakeClient()
+
+	if err := (&Migrator{client: f}).sendArgs(nil); err != nil {
+		t.Errorf("sendArgs(nil) err = %v, want nil", err)
+	}
+
+	if len(f.calls) != 0 {
+		t.Errorf("sendArgs(nil) sent %d calls, want 0", len(f.calls))
+	}
+}
+
+func TestSendArgsBulkSuccess(t *testing.T) {
+	f := newFakeClient()
+	m := &Migrator{client: f}
+
+	if err := m.sendArgs([]interface{}{"a", "b"}); err != nil {
+		t.Fatalf("sendArgs() err = %v, want nil", err)
+	}
+
+	if len(f.calls) != 1 {
+		t.Fatalf("sendArgs() sent %d calls, want 1 (a single bulk call)", len(f.calls))
+	}
+}
+
+func TestSendArgsBulkAlreadyTrackedTolerated(t *testing.T) {
+	f := newFakeClient()
+	f.bulkErr = ErrAlreadyTracked
+	m := &Migrator{client: f}
+
+	if err := m.sendArgs([]interface{}{"a"}); err != nil {
+		t.Errorf("sendArgs() err = %v, want nil (ErrAlreadyTracked should be tolerated)", err)
+	}
+}
+
+func TestSendArgsFallsBackWhenBulkUnsupported(t *testing.T) {
+	f := newFakeClient()
+	f.bulkErr = ErrBulkNotSupported
+	m := &Migrator{client: f}
+
+	if err := m.sendArgs([]interface{}{"a", "b", "c"}); err != nil {
+		t.Fatalf("sendArgs() err = %v, want nil", err)
+	}
+
+	if len(f.calls) != 1+3 {
+		t.Fatalf("sendArgs() sent %d calls, want 4 (1 failed bulk + 3 sequential)", len(f.calls))
+	}
+}
+
+func TestSendArgsFallbackToleratesAlreadyTrackedPerItem(t *testing.T) {
+	f := newFakeClient()
+	f.bulkErr = ErrBulkNotSupported
+	f.itemErr = map[int]error{1: ErrAlreadyTracked}
+	m := &Migrator{client: f}
+
+	if err := m.sendArgs([]interface{}{"a", "b", "c"}); err != nil {
+		t.Errorf("sendArgs() err = %v, want nil", err)
+	}
+}
+
+func TestSendArgsFallbackPropagatesOtherErrors(t *testing.T) {
+	f := newFakeClient()
+	f.bulkErr = ErrBulkNotSupported
+	boom := errors.New("boom")
+	f.itemErr = map[int]error{1: boom}
+	m := &Migrator{client: f}
+
+	if err := m.sendArgs([]interface{}{"a", "b", "c"}); !errors.Is(err, boom) {
+		t.Errorf("sendArgs() err = %v, want %v", err, boom)
+	}
+}
+
+// TestApplyRecordsAsYouGo verifies that when the second of two migrations
+// fails to apply, the first migration's tracking row is still recorded:
+// Apply must not collect every migration's payload into a single bulk call
+// and record them all only after every migration succeeds.
+func TestApplyRecordsAsYouGo(t *testing.T) {
+	f := newFakeClient()
+	f.failBulkForVersion = "v2"
+
+	m := NewMigrator(f, false, logrus.New())
+
+	migrations := []Migration{
+		testMigration{version: "v1", name: "first", up: func() []interface{} { return []interface{}{"a"} }},
+		testMigration{version: "v2", name: "second", up: func() []interface{} { return []interface{}{"b"} }},
+	}
+
+	if err := m.Apply(migrations); err == nil {
+		t.Fatal("Apply() err = nil, want error from the second migration")
+	}
+
+	if _, ok := f.applied["v1"]; !ok {
+		t.Error("v1 was not recorded as applied despite its bulk call succeeding")
+	}
+
+	if _, ok := f.applied["v2"]; ok {
+		t.Error("v2 was recorded as applied despite its bulk call failing")
+	}
+}
+
+func TestApplySkipsAlreadyAppliedMigrations(t *testing.T) {
+	f := newFakeClient()
+	f.applied["v1"] = checksum(testMigration{version: "v1", up: func() []interface{} { return []interface{}{"a"} }})
+
+	m := NewMigrator(f, false, logrus.New())
+
+	migrations := []Migration{
+		testMigration{version: "v1", up: func() []interface{} { return []interface{}{"a"} }},
+	}
+
+	if err := m.Apply(migrations); err != nil {
+		t.Fatalf("Apply() err = %v, want nil", err)
+	}
+
+	for _, c := range f.calls {
+		if _, ok := c.(BulkMetadata); ok {
+			t.Error("Apply() re-sent an already applied migration's Up()")
+		}
+	}
+}
+
+func TestRollbackToRemovesRecordsAsYouGo(t *testing.T) {
+	f := newFakeClient()
+	f.applied["v1"] = checksum(testMigration{version: "v1", up: func() []interface{} { return []interface{}{"a"} }})
+	f.applied["v2"] = checksum(testMigration{version: "v2", up: func() []interface{} { return []interface{}{"b"} }})
+
+	m := NewMigrator(f, false, logrus.New())
+
+	migrations := []Migration{
+		testMigration{version: "v1", down: func() []interface{} { return []interface{}{"down-a"} }},
+		testMigration{version: "v2", down: func() []interface{} { return []interface{}{"down-b"} }},
+	}
+
+	if err := m.RollbackTo("v0", migrations); err != nil {
+		t.Fatalf("RollbackTo() err = %v, want nil", err)
+	}
+
+	if len(f.applied) != 0 {
+		t.Errorf("RollbackTo() left %d applied migrations, want 0", len(f.applied))
+	}
+
+	var order []string
+
+	for _, c := range f.calls {
+		switch v := c.(type) {
+		case BulkMetadata:
+			order = append(order, v.Args[0].(string))
+		case RunSQL:
+			if strings.HasPrefix(v.Args.SQL, "DELETE FROM") {
+				order = append(order, "delete")
+			}
+		}
+	}
+
+	if got := strings.Join(order, ","); got != "down-b,delete,down-a,delete" {
+		t.Errorf("RollbackTo() call order = %s, want each record deleted right after its Down() call", got)
+	}
+}
+
+func TestDiffReportsPendingChangedAndOrphaned(t *testing.T) {
+	f := newFakeClient()
+
+	unchanged := testMigration{version: "v1", name: "unchanged", up: func() []interface{} { return []interface{}{"a"} }}
+	f.applied["v1"] = checksum(unchanged)
+
+	changed := testMigration{version: "v2", name: "changed", up: func() []interface{} { return []interface{}{"new-payload"} }}
+	f.applied["v2"] = checksum(testMigration{version: "v2", up: func() []interface{} { return []interface{}{"old-payload"} }})
+
+	f.applied["v3"] = "some-checksum"
+
+	pending := testMigration{version: "v4", name: "pending", up: func() []interface{} { return []interface{}{"d"} }}
+
+	m := NewMigrator(f, false, logrus.New())
+
+	report, err := m.Diff([]Migration{unchanged, changed, pending})
+	if err != nil {
+		t.Fatalf("Diff() err = %v, want nil", err)
+	}
+
+	for _, want := range []string{"pending: v4", "changed: v2", "orphaned: v3"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Diff() = %q, want it to contain %q", report, want)
+		}
+	}
+
+	if strings.Contains(report, "v1") {
+		t.Errorf("Diff() = %q, want no mention of unchanged migration v1", report)
+	}
+}
+
+func TestDiffNoDrift(t *testing.T) {
+	f := newFakeClient()
+
+	mig := testMigration{version: "v1", name: "only", up: func() []interface{} { return []interface{}{"a"} }}
+	f.applied["v1"] = checksum(mig)
+
+	m := NewMigrator(f, false, logrus.New())
+
+	report, err := m.Diff([]Migration{mig})
+	if err != nil {
+		t.Fatalf("Diff() err = %v, want nil", err)
+	}
+
+	if report != "no drift: every known migration is applied and unchanged" {
+		t.Errorf("Diff() = %q, want the no-drift message", report)
+	}
+}
+
+// testMigration is a Migration whose Up/Down are supplied directly, for use
+// in tests that don't need a real metadata payload.
+type testMigration struct {
+	version string
+	name    string
+	up      func() []interface{}
+	down    func() []interface{}
+}
+
+func (m testMigration) Version() string { return m.version }
+func (m testMigration) Name() string    { return m.name }
+
+func (m testMigration) Up() []interface{} {
+	if m.up == nil {
+		return nil
+	}
+
+	return m.up()
+}
+
+func (m testMigration) Down() []interface{} {
+	if m.down == nil {
+		return nil
+	}
+
+	return m.down()
+}
+
+// fakeClient is an in-memory MetadataClient that answers the run_sql calls
+// Migrator uses to track applied migrations, so Apply/RollbackTo can be
+// exercised without a real Hasura instance. failBulkForVersion, when
+// non-empty, fails every bulk call that carries the payload "b" (the Up()
+// of the "v2" testMigration in these tests); the version string itself is
+// not compared.
+type fakeClient struct {
+	calls              []interface{}
+	applied            map[string]string
+	bulkErr            error
+	itemErr            map[int]error
+	itemCallCount      int
+	failBulkForVersion string
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{applied: make(map[string]string)}
+}
+
+func (f *fakeClient) Source() string { return "default" }
+func (f *fakeClient) Schema() string { return "storage" }
+
+var sqlQuotedValue = regexp.MustCompile(`'([A-Za-z0-9_.:-]+)'`)
+
+func (f *fakeClient) Send(data interface{}) ([]byte, error) {
+	f.calls = append(f.calls, data)
+
+	switch v := data.(type) {
+	case RunSQL:
+		return f.sendRunSQL(v)
+	case BulkMetadata:
+		return f.sendBulk(v)
+	default:
+		idx := f.itemCallCount
+		f.itemCallCount++
+
+		if err, ok := f.itemErr[idx]; ok {
+			return nil, err
+		}
+
+		return []byte(`{}`), nil
+	}
+}
+
+func (f *fakeClient) sendBulk(v BulkMetadata) ([]byte, error) {
+	if f.failBulkForVersion != "" {
+		for _, arg := range v.Args {
+			if mig, ok := arg.(string); ok && mig == "b" {
+				return nil, errors.New("bulk failed") // nolint: goerr113
+			}
+		}
+	}
+
+	if f.bulkErr != nil {
+		return nil, f.bulkErr
+	}
+
+	return []byte(`{}`), nil
+}
+
+func (f *fakeClient) sendRunSQL(v RunSQL) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(v.Args.SQL, "CREATE TABLE"):
+		return []byte(`{}`), nil
+	case strings.HasPrefix(v.Args.SQL, "SELECT name"):
+		return f.renderAppliedVersions(), nil
+	case strings.HasPrefix(v.Args.SQL, "INSERT INTO"):
+		values := sqlQuotedValue.FindAllStringSubmatch(v.Args.SQL, -1)
+		f.applied[values[0][1]] = values[1][1]
+
+		return []byte(`{}`), nil
+	case strings.HasPrefix(v.Args.SQL, "DELETE FROM"):
+		values := sqlQuotedValue.FindAllStringSubmatch(v.Args.SQL, -1)
+		delete(f.applied, values[0][1])
+
+		return []byte(`{}`), nil
+	default:
+		return []byte(`{}`), nil
+	}
+}
+
+func (f *fakeClient) renderAppliedVersions() []byte {
+	var b strings.Builder
+
+	b.WriteString(`{"result_type":"TuplesOk","result":[["name","applied_at","checksum"]`)
+
+	for name, sum := range f.applied {
+		b.WriteString(`,["` + name + `","2020-01-01T00:00:00Z","` + sum + `"]`)
+	}
+
+	b.WriteString(`]}`)
+
+	return []byte(b.String())
+}
@@ -0,0 +1,392 @@
+package migrations
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// PermissionPreset names a canned filter/check ruleset for a Hasura role's
+// row-level permissions on a storage table. Operators that need something
+// the presets don't cover use PermissionPresetCustom and supply their own
+// Filter/Check on RolePermission.
+type PermissionPreset string
+
+const (
+	// PermissionPresetOwnerOnly restricts rows to the ones uploaded by the
+	// requesting user.
+	PermissionPresetOwnerOnly PermissionPreset = "owner_only"
+	// PermissionPresetPublicRead allows unrestricted access to every row.
+	PermissionPresetPublicRead PermissionPreset = "public_read"
+	// PermissionPresetBucketScoped restricts rows to the bucket named by
+	// the X-Hasura-Bucket-Id session variable.
+	PermissionPresetBucketScoped PermissionPreset = "bucket_scoped"
+	// PermissionPresetCustom means RolePermission.Filter/Check are used
+	// as-is instead of being derived from a preset.
+	PermissionPresetCustom PermissionPreset = "custom"
+)
+
+// readOnly reports whether a preset should only ever grant select access.
+// PermissionPresetPublicRead's rule() is an unrestricted (empty) filter,
+// which would otherwise also be used as an unrestricted insert/update/delete
+// check — granting anonymous, unauthenticated callers full write access to
+// the table. Custom roles are responsible for their own Check/Filter, so
+// they're never treated as read-only here.
+func (p PermissionPreset) readOnly() bool {
+	return p == PermissionPresetPublicRead
+}
+
+// rule expands the preset into a filter/check for table. Presets are
+// defined in terms of storage.files' own columns (uploaded_by_user_id,
+// bucket_id), which don't exist on every table a preset is applied to, so
+// tables without them are given an equivalent rule through a tracked
+// relationship (or, for bucket_scoped on buckets, through its own id)
+// instead of reusing the files-shaped rule verbatim.
+func (p PermissionPreset) rule(table string) map[string]interface{} {
+	switch p {
+	case PermissionPresetOwnerOnly:
+		return ownerOnlyRule(table)
+	case PermissionPresetBucketScoped:
+		return bucketScopedRule(table)
+	case PermissionPresetPublicRead, PermissionPresetCustom:
+		return map[string]interface{}{}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func ownerOnlyRule(table string) map[string]interface{} {
+	switch table {
+	case "buckets":
+		// storage.buckets has no uploaded_by_user_id column of its own;
+		// scope it through the files it contains via the "files" array
+		// relationship baseMigration tracks.
+		return map[string]interface{}{
+			"files": map[string]interface{}{
+				"uploaded_by_user_id": map[string]interface{}{"_eq": "X-Hasura-User-Id"},
+			},
+		}
+	case fileEventsTable:
+		// storage.file_events has no uploaded_by_user_id column either;
+		// scope it through the file it's about via the "file" object
+		// relationship EventTriggersMigration tracks.
+		return map[string]interface{}{
+			"file": map[string]interface{}{
+				"uploaded_by_user_id": map[string]interface{}{"_eq": "X-Hasura-User-Id"},
+			},
+		}
+	default:
+		return map[string]interface{}{
+			"uploaded_by_user_id": map[string]interface{}{"_eq": "X-Hasura-User-Id"},
+		}
+	}
+}
+
+func bucketScopedRule(table string) map[string]interface{} {
+	switch table {
+	case "buckets":
+		// storage.buckets doesn't have a bucket_id column — it's the
+		// bucket, so the session variable is matched against its own id.
+		return map[string]interface{}{"id": map[string]interface{}{"_eq": "X-Hasura-Bucket-Id"}}
+	case fileEventsTable:
+		// storage.file_events has no bucket_id column; scope it through
+		// the "file" object relationship EventTriggersMigration tracks.
+		return map[string]interface{}{
+			"file": map[string]interface{}{
+				"bucket_id": map[string]interface{}{"_eq": "X-Hasura-Bucket-Id"},
+			},
+		}
+	}
+
+	return map[string]interface{}{"bucket_id": map[string]interface{}{"_eq": "X-Hasura-Bucket-Id"}}
+}
+
+// RolePermission describes the select/insert/update/delete access a single
+// Hasura role should have on a storage table.
+type RolePermission struct {
+	Role   string
+	Preset PermissionPreset
+	// Columns defaults to every column ("*") when left empty.
+	Columns []string
+	// Filter and Check are only read when Preset is PermissionPresetCustom;
+	// otherwise they're derived from the preset.
+	Filter map[string]interface{}
+	Check  map[string]interface{}
+}
+
+func (r RolePermission) columns() []string {
+	if len(r.Columns) == 0 {
+		return []string{"*"}
+	}
+
+	return r.Columns
+}
+
+func (r RolePermission) filter(table string) map[string]interface{} {
+	if r.Preset == PermissionPresetCustom {
+		return r.Filter
+	}
+
+	return r.Preset.rule(table)
+}
+
+func (r RolePermission) check(table string) map[string]interface{} {
+	if r.Preset == PermissionPresetCustom {
+		return r.Check
+	}
+
+	return r.Preset.rule(table)
+}
+
+// DefaultRoles are the roles hasura-storage provisions permissions for out
+// of the box. Operators can override this list entirely via
+// LoadRolePermissions and the presets shipped under migrations/presets/.
+var DefaultRoles = []RolePermission{
+	{Role: "user", Preset: PermissionPresetOwnerOnly},
+	{Role: "anonymous", Preset: PermissionPresetPublicRead},
+	{Role: "service", Preset: PermissionPresetPublicRead},
+}
+
+// nolint: tagliatelle
+type SelectPermissionDefinition struct {
+	Columns           []string               `json:"columns"`
+	Filter            map[string]interface{} `json:"filter"`
+	AllowAggregations bool                   `json:"allow_aggregations"`
+}
+
+type CreateSelectPermissionArgs struct {
+	Source     string                     `json:"source"`
+	Table      Table                      `json:"table"`
+	Role       string                     `json:"role"`
+	Permission SelectPermissionDefinition `json:"permission"`
+}
+
+type CreateSelectPermission struct {
+	Type string                     `json:"type"`
+	Args CreateSelectPermissionArgs `json:"args"`
+}
+
+type InsertPermissionDefinition struct {
+	Columns []string               `json:"columns"`
+	Check   map[string]interface{} `json:"check"`
+}
+
+type CreateInsertPermissionArgs struct {
+	Source     string                     `json:"source"`
+	Table      Table                      `json:"table"`
+	Role       string                     `json:"role"`
+	Permission InsertPermissionDefinition `json:"permission"`
+}
+
+type CreateInsertPermission struct {
+	Type string                     `json:"type"`
+	Args CreateInsertPermissionArgs `json:"args"`
+}
+
+type UpdatePermissionDefinition struct {
+	Columns []string               `json:"columns"`
+	Filter  map[string]interface{} `json:"filter"`
+	Check   map[string]interface{} `json:"check"`
+}
+
+type CreateUpdatePermissionArgs struct {
+	Source     string                     `json:"source"`
+	Table      Table                      `json:"table"`
+	Role       string                     `json:"role"`
+	Permission UpdatePermissionDefinition `json:"permission"`
+}
+
+type CreateUpdatePermission struct {
+	Type string                     `json:"type"`
+	Args CreateUpdatePermissionArgs `json:"args"`
+}
+
+type DeletePermissionDefinition struct {
+	Filter map[string]interface{} `json:"filter"`
+}
+
+type CreateDeletePermissionArgs struct {
+	Source     string                     `json:"source"`
+	Table      Table                      `json:"table"`
+	Role       string                     `json:"role"`
+	Permission DeletePermissionDefinition `json:"permission"`
+}
+
+type CreateDeletePermission struct {
+	Type string                     `json:"type"`
+	Args CreateDeletePermissionArgs `json:"args"`
+}
+
+type dropPermissionArgs struct {
+	Source string `json:"source"`
+	Table  Table  `json:"table"`
+	Role   string `json:"role"`
+}
+
+type dropPermission struct {
+	Type string             `json:"type"`
+	Args dropPermissionArgs `json:"args"`
+}
+
+func newDropPermission(typ, source string, table Table, role string) dropPermission {
+	return dropPermission{Type: typ, Args: dropPermissionArgs{Source: source, Table: table, Role: role}}
+}
+
+// permissionedTables are the storage tables PermissionsMigration provisions
+// role permissions on.
+var permissionedTables = []string{"buckets", "files"}
+
+// PermissionsMigration provisions select/insert/update/delete permissions
+// for a set of roles on storage.files and storage.buckets, so operators no
+// longer have to hand-write them in the Hasura console after every
+// ApplyHasuraMetadata run.
+type PermissionsMigration struct {
+	source string
+	schema string
+	roles  []RolePermission
+}
+
+// NewPermissionsMigration returns a Migration that grants roles access to
+// storage.files and storage.buckets. Pass DefaultRoles to provision the
+// user/anonymous/service roles hasura-storage ships by default, or roles
+// loaded via LoadRolePermissions to override them.
+func NewPermissionsMigration(client MetadataClient, roles []RolePermission) *PermissionsMigration {
+	return &PermissionsMigration{source: client.Source(), schema: client.Schema(), roles: roles}
+}
+
+func (p *PermissionsMigration) Version() string { return "20220101000000_storage_permissions" }
+func (p *PermissionsMigration) Name() string    { return "storage permissions for files and buckets" }
+
+// nolint: funlen
+func (p *PermissionsMigration) Up() []interface{} {
+	var args []interface{}
+
+	for _, name := range permissionedTables {
+		table := Table{Schema: p.schema, Name: name}
+
+		for _, role := range p.roles {
+			args = append(args, CreateSelectPermission{
+				Type: "pg_create_select_permission",
+				Args: CreateSelectPermissionArgs{
+					Source: p.source,
+					Table:  table,
+					Role:   role.Role,
+					Permission: SelectPermissionDefinition{
+						Columns: role.columns(),
+						Filter:  role.filter(name),
+					},
+				},
+			})
+
+			// PermissionPresetPublicRead grants select only: its rule() is
+			// an unrestricted filter, which as a check would let anonymous
+			// callers insert/update/delete every row.
+			if role.Preset.readOnly() {
+				continue
+			}
+
+			args = append(args,
+				CreateInsertPermission{
+					Type: "pg_create_insert_permission",
+					Args: CreateInsertPermissionArgs{
+						Source: p.source,
+						Table:  table,
+						Role:   role.Role,
+						Permission: InsertPermissionDefinition{
+							Columns: role.columns(),
+							Check:   role.check(name),
+						},
+					},
+				},
+				CreateUpdatePermission{
+					Type: "pg_create_update_permission",
+					Args: CreateUpdatePermissionArgs{
+						Source: p.source,
+						Table:  table,
+						Role:   role.Role,
+						Permission: UpdatePermissionDefinition{
+							Columns: role.columns(),
+							Filter:  role.filter(name),
+							Check:   role.check(name),
+						},
+					},
+				},
+				CreateDeletePermission{
+					Type: "pg_create_delete_permission",
+					Args: CreateDeletePermissionArgs{
+						Source:     p.source,
+						Table:      table,
+						Role:       role.Role,
+						Permission: DeletePermissionDefinition{Filter: role.filter(name)},
+					},
+				},
+			)
+		}
+	}
+
+	return args
+}
+
+func (p *PermissionsMigration) Down() []interface{} {
+	var args []interface{}
+
+	for _, name := range permissionedTables {
+		table := Table{Schema: p.schema, Name: name}
+
+		for _, role := range p.roles {
+			args = append(args, newDropPermission("pg_drop_select_permission", p.source, table, role.Role))
+
+			if role.Preset.readOnly() {
+				continue
+			}
+
+			args = append(args,
+				newDropPermission("pg_drop_insert_permission", p.source, table, role.Role),
+				newDropPermission("pg_drop_update_permission", p.source, table, role.Role),
+				newDropPermission("pg_drop_delete_permission", p.source, table, role.Role),
+			)
+		}
+	}
+
+	return args
+}
+
+// rolePermissionFile is the on-disk shape for operator-supplied permission
+// overrides, in the JSON files shipped under migrations/presets/. Only JSON
+// is parsed; YAML files are not supported.
+// nolint: tagliatelle
+type rolePermissionFile struct {
+	Role    string                 `json:"role"`
+	Preset  string                 `json:"preset"`
+	Columns []string               `json:"columns,omitempty"`
+	Filter  map[string]interface{} `json:"filter,omitempty"`
+	Check   map[string]interface{} `json:"check,omitempty"`
+}
+
+// LoadRolePermissions reads a JSON file describing role permission
+// overrides so operators can change who can read and write storage.files
+// and storage.buckets without recompiling hasura-storage.
+func LoadRolePermissions(path string) ([]RolePermission, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading role permissions file %s: %w", path, err)
+	}
+
+	var files []rolePermissionFile
+	if err := json.Unmarshal(b, &files); err != nil {
+		return nil, fmt.Errorf("problem parsing role permissions file %s: %w", path, err)
+	}
+
+	roles := make([]RolePermission, 0, len(files))
+	for _, f := range files {
+		roles = append(roles, RolePermission{
+			Role:    f.Role,
+			Preset:  PermissionPreset(f.Preset),
+			Columns: f.Columns,
+			Filter:  f.Filter,
+			Check:   f.Check,
+		})
+	}
+
+	return roles, nil
+}
@@ -0,0 +1,162 @@
+package migrations
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPermissionPresetReadOnly(t *testing.T) {
+	tests := []struct {
+		preset PermissionPreset
+		want   bool
+	}{
+		{PermissionPresetPublicRead, true},
+		{PermissionPresetOwnerOnly, false},
+		{PermissionPresetBucketScoped, false},
+		{PermissionPresetCustom, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.preset.readOnly(); got != tt.want {
+			t.Errorf("%s.readOnly() = %v, want %v", tt.preset, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionsMigrationUpSkipsWritePermissionsForReadOnlyPresets(t *testing.T) {
+	client := &fakeClient{applied: make(map[string]string)}
+
+	roles := []RolePermission{
+		{Role: "anonymous", Preset: PermissionPresetPublicRead},
+		{Role: "user", Preset: PermissionPresetOwnerOnly},
+	}
+
+	mig := NewPermissionsMigration(client, roles)
+
+	var selects, inserts, updates, deletes int
+
+	for _, arg := range mig.Up() {
+		switch v := arg.(type) {
+		case CreateSelectPermission:
+			selects++
+		case CreateInsertPermission:
+			inserts++
+			if v.Args.Role == "anonymous" {
+				t.Error("anonymous (public_read) got an insert permission, want select-only")
+			}
+		case CreateUpdatePermission:
+			updates++
+		case CreateDeletePermission:
+			deletes++
+		}
+	}
+
+	// 2 roles x 2 tables (buckets, files) = 4 select permissions; only
+	// "user" (owner_only) gets insert/update/delete, so 2 of each.
+	if selects != 4 {
+		t.Errorf("got %d select permissions, want 4", selects)
+	}
+
+	if inserts != 2 || updates != 2 || deletes != 2 {
+		t.Errorf("got inserts=%d updates=%d deletes=%d, want 2 each", inserts, updates, deletes)
+	}
+}
+
+func TestPermissionsMigrationDownMirrorsUp(t *testing.T) {
+	client := &fakeClient{applied: make(map[string]string)}
+
+	roles := []RolePermission{{Role: "anonymous", Preset: PermissionPresetPublicRead}}
+
+	mig := NewPermissionsMigration(client, roles)
+
+	for _, arg := range mig.Down() {
+		dp, ok := arg.(dropPermission)
+		if !ok {
+			t.Fatalf("Down() returned %T, want dropPermission", arg)
+		}
+
+		if dp.Type != "pg_drop_select_permission" {
+			t.Errorf("public_read role got %s dropped, want only pg_drop_select_permission", dp.Type)
+		}
+	}
+}
+
+func TestPermissionPresetRule(t *testing.T) {
+	owner := PermissionPresetOwnerOnly.rule("files")
+	if _, ok := owner["uploaded_by_user_id"]; !ok {
+		t.Errorf("owner_only rule(files) = %v, want uploaded_by_user_id filter", owner)
+	}
+
+	bucket := PermissionPresetBucketScoped.rule("files")
+	if _, ok := bucket["bucket_id"]; !ok {
+		t.Errorf("bucket_scoped rule(files) = %v, want bucket_id filter", bucket)
+	}
+
+	if rule := PermissionPresetPublicRead.rule("files"); len(rule) != 0 {
+		t.Errorf("public_read rule(files) = %v, want empty (unrestricted)", rule)
+	}
+}
+
+func TestPermissionPresetRuleIsTableAware(t *testing.T) {
+	ownerBuckets := PermissionPresetOwnerOnly.rule("buckets")
+	if _, ok := ownerBuckets["uploaded_by_user_id"]; ok {
+		t.Errorf("owner_only rule(buckets) = %v, want no uploaded_by_user_id (buckets has no such column)", ownerBuckets)
+	}
+
+	if _, ok := ownerBuckets["files"]; !ok {
+		t.Errorf("owner_only rule(buckets) = %v, want a filter scoped through the files relationship", ownerBuckets)
+	}
+
+	bucketScopedBuckets := PermissionPresetBucketScoped.rule("buckets")
+	if _, ok := bucketScopedBuckets["bucket_id"]; ok {
+		t.Errorf("bucket_scoped rule(buckets) = %v, want no bucket_id (buckets has no such column)", bucketScopedBuckets)
+	}
+
+	if _, ok := bucketScopedBuckets["id"]; !ok {
+		t.Errorf("bucket_scoped rule(buckets) = %v, want a filter on buckets' own id", bucketScopedBuckets)
+	}
+
+	ownerFileEvents := PermissionPresetOwnerOnly.rule(fileEventsTable)
+	if _, ok := ownerFileEvents["file"]; !ok {
+		t.Errorf("owner_only rule(file_events) = %v, want a filter scoped through the file relationship", ownerFileEvents)
+	}
+}
+
+func TestLoadRolePermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "roles.json")
+
+	const contents = `[
+		{"role": "user", "preset": "owner_only"},
+		{"role": "anonymous", "preset": "public_read"},
+		{"role": "reporting", "preset": "custom", "columns": ["id"], "filter": {"a": 1}, "check": {"b": 2}}
+	]`
+
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("problem writing fixture: %s", err)
+	}
+
+	roles, err := LoadRolePermissions(path)
+	if err != nil {
+		t.Fatalf("LoadRolePermissions() err = %v, want nil", err)
+	}
+
+	if len(roles) != 3 {
+		t.Fatalf("LoadRolePermissions() returned %d roles, want 3", len(roles))
+	}
+
+	if roles[0].Role != "user" || roles[0].Preset != PermissionPresetOwnerOnly {
+		t.Errorf("roles[0] = %+v, want user/owner_only", roles[0])
+	}
+
+	if roles[2].Role != "reporting" || roles[2].Preset != PermissionPresetCustom || len(roles[2].Columns) != 1 {
+		t.Errorf("roles[2] = %+v, want custom reporting role with 1 column", roles[2])
+	}
+}
+
+func TestLoadRolePermissionsMissingFile(t *testing.T) {
+	if _, err := LoadRolePermissions(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadRolePermissions(missing file) err = nil, want error")
+	}
+}
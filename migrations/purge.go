@@ -0,0 +1,227 @@
+package migrations
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const purgeCronTriggerName = "storage_purge_expired_files"
+
+// nolint: tagliatelle
+type CronRetryConf struct {
+	NumRetries           int `json:"num_retries"`
+	TimeoutSeconds       int `json:"timeout_seconds"`
+	ToleranceSeconds     int `json:"tolerance_seconds"`
+	RetryIntervalSeconds int `json:"retry_interval_seconds"`
+}
+
+// TrackCronTrigger registers a Hasura scheduled trigger, mirroring the
+// TrackTable/CreateObjectRelationship naming even though the underlying
+// metadata type is create_cron_trigger rather than pg_track_table.
+type TrackCronTrigger struct {
+	Type string               `json:"type"`
+	Args TrackCronTriggerArgs `json:"args"`
+}
+
+// nolint: tagliatelle
+type TrackCronTriggerArgs struct {
+	Name      string        `json:"name"`
+	Webhook   string        `json:"webhook"`
+	Schedule  string        `json:"schedule"`
+	Payload   interface{}   `json:"payload"`
+	RetryConf CronRetryConf `json:"retry_conf"`
+}
+
+// DropCronTrigger removes a previously registered scheduled trigger.
+type DropCronTrigger struct {
+	Type string              `json:"type"`
+	Args DropCronTriggerArgs `json:"args"`
+}
+
+type DropCronTriggerArgs struct {
+	Name string `json:"name"`
+}
+
+// PurgeConfig configures the scheduled purge of expired/unreferenced files.
+// It is behind the Enabled feature flag so existing deployments that
+// ApplyHasuraMetadata don't suddenly start purging files.
+type PurgeConfig struct {
+	Enabled bool
+	// PurgeDays is how old a file must be, in days, before it becomes
+	// eligible for purging. Defaults to defaultPurgeDays when zero or
+	// negative.
+	PurgeDays int
+	// PurgeInterval is how often, in hours, the purge trigger fires.
+	// Defaults to defaultPurgeIntervalHours when zero or negative; values
+	// above 23 would overflow the "0 */N * * *" schedule into a cron field
+	// that no longer means what the operator asked for, so it's clamped to
+	// that range too.
+	PurgeInterval int
+	// WebhookURL is the hasura-storage endpoint PurgeHandler is mounted
+	// on, which the cron trigger calls.
+	WebhookURL string
+}
+
+const (
+	defaultPurgeDays          = 30
+	defaultPurgeIntervalHours = 24
+	maxPurgeIntervalHours     = 23
+)
+
+func (c PurgeConfig) purgeDays() int {
+	if c.PurgeDays <= 0 {
+		return defaultPurgeDays
+	}
+
+	return c.PurgeDays
+}
+
+func (c PurgeConfig) purgeIntervalHours() int {
+	switch {
+	case c.PurgeInterval <= 0:
+		return defaultPurgeIntervalHours
+	case c.PurgeInterval > maxPurgeIntervalHours:
+		return maxPurgeIntervalHours
+	default:
+		return c.PurgeInterval
+	}
+}
+
+func (c PurgeConfig) schedule() string {
+	return fmt.Sprintf("0 */%d * * *", c.purgeIntervalHours())
+}
+
+// PurgeMigration registers (or removes) the Hasura scheduled trigger that
+// drives the purge of expired files.
+type PurgeMigration struct {
+	cfg PurgeConfig
+}
+
+// NewPurgeMigration returns a Migration that registers the purge cron
+// trigger described by cfg. Up and Down are no-ops when cfg.Enabled is
+// false.
+func NewPurgeMigration(cfg PurgeConfig) *PurgeMigration {
+	return &PurgeMigration{cfg: cfg}
+}
+
+func (p *PurgeMigration) Version() string { return "20220201000000_storage_purge_cron_trigger" }
+func (p *PurgeMigration) Name() string    { return "scheduled purge of expired files" }
+
+func (p *PurgeMigration) Up() []interface{} {
+	if !p.cfg.Enabled {
+		return nil
+	}
+
+	return []interface{}{
+		TrackCronTrigger{
+			Type: "create_cron_trigger",
+			Args: TrackCronTriggerArgs{
+				Name:     purgeCronTriggerName,
+				Webhook:  p.cfg.WebhookURL,
+				Schedule: p.cfg.schedule(),
+				Payload:  map[string]interface{}{"purge_days": p.cfg.purgeDays()},
+				RetryConf: CronRetryConf{
+					NumRetries:           3,
+					TimeoutSeconds:       60,
+					ToleranceSeconds:     21600,
+					RetryIntervalSeconds: 10,
+				},
+			},
+		},
+	}
+}
+
+func (p *PurgeMigration) Down() []interface{} {
+	if !p.cfg.Enabled {
+		return nil
+	}
+
+	return []interface{}{
+		DropCronTrigger{Type: "delete_cron_trigger", Args: DropCronTriggerArgs{Name: purgeCronTriggerName}},
+	}
+}
+
+// FileRecord is the minimal storage.files row PurgeHandler needs to decide
+// whether a file is eligible for purging.
+type FileRecord struct {
+	ID         string
+	BucketID   string
+	IsUploaded bool
+	CreatedAt  time.Time
+}
+
+// FileStore is the persistence boundary PurgeHandler uses to find and
+// tombstone expired files.
+type FileStore interface {
+	// ExpiredFiles returns files created before olderThan that are either
+	// not yet uploaded or match filter (a caller-supplied GraphQL-style
+	// where clause; nil matches only on the is_uploaded condition).
+	ExpiredFiles(olderThan time.Time, filter map[string]interface{}) ([]FileRecord, error)
+	// Tombstone marks a file as deleted in storage.files so Hasura
+	// subscriptions observe the removal before the bytes are gone.
+	Tombstone(id string) error
+}
+
+// ObjectBackend removes file bytes from whatever is backing object storage.
+type ObjectBackend interface {
+	Delete(bucketID, id string) error
+}
+
+// cronPayload is the body the storage_purge_expired_files trigger POSTs,
+// matching the payload configured in TrackCronTriggerArgs.
+// nolint: tagliatelle
+type cronPayload struct {
+	PurgeDays int                    `json:"purge_days"`
+	Filter    map[string]interface{} `json:"filter,omitempty"`
+}
+
+// PurgeHandler implements the HTTP endpoint the storage_purge_expired_files
+// cron trigger calls.
+type PurgeHandler struct {
+	store   FileStore
+	backend ObjectBackend
+	logger  *logrus.Logger
+}
+
+// NewPurgeHandler returns a PurgeHandler that purges through store and
+// backend.
+func NewPurgeHandler(store FileStore, backend ObjectBackend, logger *logrus.Logger) *PurgeHandler {
+	return &PurgeHandler{store: store, backend: backend, logger: logger}
+}
+
+// ServeHTTP tombstones and deletes every file older than the purge window
+// requested in the trigger payload that is either unfinished or matches
+// the payload's filter. Rows are tombstoned before their bytes are removed
+// from the object backend so Hasura subscriptions see the deletion first.
+func (h *PurgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload cronPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, fmt.Sprintf("problem decoding purge trigger payload: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	olderThan := time.Now().AddDate(0, 0, -payload.PurgeDays)
+
+	files, err := h.store.ExpiredFiles(olderThan, payload.Filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("problem listing expired files: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	for _, f := range files {
+		if err := h.store.Tombstone(f.ID); err != nil {
+			h.logger.Errorf("problem tombstoning file %s: %s", f.ID, err)
+			continue
+		}
+
+		if err := h.backend.Delete(f.BucketID, f.ID); err != nil {
+			h.logger.Errorf("problem deleting file %s from object backend: %s", f.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
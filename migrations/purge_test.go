@@ -0,0 +1,133 @@
+package migrations
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestPurgeConfigDefaultsAndClamps(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          PurgeConfig
+		wantDays     int
+		wantSchedule string
+	}{
+		{"zero values default", PurgeConfig{}, defaultPurgeDays, "0 */24 * * *"},
+		{"negative values default", PurgeConfig{PurgeDays: -1, PurgeInterval: -5}, defaultPurgeDays, "0 */24 * * *"},
+		{"in-range values pass through", PurgeConfig{PurgeDays: 7, PurgeInterval: 6}, 7, "0 */6 * * *"},
+		{"interval above max is clamped", PurgeConfig{PurgeInterval: 48}, defaultPurgeDays, "0 */23 * * *"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.cfg.purgeDays(); got != tt.wantDays {
+			t.Errorf("%s: purgeDays() = %d, want %d", tt.name, got, tt.wantDays)
+		}
+
+		if got := tt.cfg.schedule(); got != tt.wantSchedule {
+			t.Errorf("%s: schedule() = %q, want %q", tt.name, got, tt.wantSchedule)
+		}
+	}
+}
+
+func TestPurgeMigrationUpUsesValidatedSchedule(t *testing.T) {
+	mig := NewPurgeMigration(PurgeConfig{Enabled: true, WebhookURL: "http://example.invalid"})
+
+	args := mig.Up()
+	if len(args) != 1 {
+		t.Fatalf("Up() returned %d args, want 1", len(args))
+	}
+
+	trigger, ok := args[0].(TrackCronTrigger)
+	if !ok {
+		t.Fatalf("Up()[0] = %T, want TrackCronTrigger", args[0])
+	}
+
+	if trigger.Args.Schedule != "0 */24 * * *" {
+		t.Errorf("Schedule = %q, want %q", trigger.Args.Schedule, "0 */24 * * *")
+	}
+}
+
+func TestPurgeMigrationDisabledIsNoOp(t *testing.T) {
+	mig := NewPurgeMigration(PurgeConfig{Enabled: false})
+
+	if up := mig.Up(); up != nil {
+		t.Errorf("Up() = %v, want nil when disabled", up)
+	}
+
+	if down := mig.Down(); down != nil {
+		t.Errorf("Down() = %v, want nil when disabled", down)
+	}
+}
+
+type fakeFileStore struct {
+	files      []FileRecord
+	tombstoned []string
+	olderThans []time.Time
+}
+
+func (s *fakeFileStore) ExpiredFiles(olderThan time.Time, filter map[string]interface{}) ([]FileRecord, error) {
+	s.olderThans = append(s.olderThans, olderThan)
+
+	return s.files, nil
+}
+
+func (s *fakeFileStore) Tombstone(id string) error {
+	s.tombstoned = append(s.tombstoned, id)
+
+	return nil
+}
+
+type fakeObjectBackend struct {
+	deleted []string
+}
+
+func (b *fakeObjectBackend) Delete(bucketID, id string) error {
+	b.deleted = append(b.deleted, id)
+
+	return nil
+}
+
+func TestPurgeHandlerTombstonesAndDeletesExpiredFiles(t *testing.T) {
+	store := &fakeFileStore{files: []FileRecord{{ID: "f1", BucketID: "b1"}, {ID: "f2", BucketID: "b1"}}}
+	backend := &fakeObjectBackend{}
+
+	handler := NewPurgeHandler(store, backend, logrus.New())
+
+	req := httptest.NewRequest(http.MethodPost, "/purge", bytes.NewBufferString(`{"purge_days": 30}`))
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if len(store.tombstoned) != 2 {
+		t.Errorf("tombstoned %d files, want 2", len(store.tombstoned))
+	}
+
+	if len(backend.deleted) != 2 {
+		t.Errorf("deleted %d files from backend, want 2", len(backend.deleted))
+	}
+}
+
+func TestPurgeHandlerRejectsMalformedPayload(t *testing.T) {
+	store := &fakeFileStore{}
+	backend := &fakeObjectBackend{}
+
+	handler := NewPurgeHandler(store, backend, logrus.New())
+
+	req := httptest.NewRequest(http.MethodPost, "/purge", bytes.NewBufferString(`not json`))
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}